@@ -0,0 +1,23 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileid identifies a file by device and inode number so the dircounts
+// walker can recognize symlink cycles and hard-linked duplicates.
+type fileid struct {
+	dev uint64
+	ino uint64
+}
+
+func fileId(fi os.FileInfo, path string) fileid {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileid{}
+	}
+	return fileid{dev: uint64(st.Dev), ino: st.Ino}
+}
@@ -0,0 +1,18 @@
+// +build windows
+
+package main
+
+import "os"
+
+// fileid identifies a file for the dircounts walker. Windows' os.FileInfo
+// does not expose an inode number cheaply, so we fall back to the path the
+// walker reached the file by (symlinks are not resolved): this still stops
+// cycles made of repeated paths, though it won't
+// catch hard-link duplicates the way the dev/ino pair does on unix.
+type fileid struct {
+	path string
+}
+
+func fileId(fi os.FileInfo, path string) fileid {
+	return fileid{path: path}
+}
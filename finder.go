@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// number of goroutines normalizing and indexing paths produced by the
+// filepath.Walk producer
+const finderIndexers = 4
+
+// paths are pushed through sleep/resume in batches of this size so the
+// indexer can be throttled without sleeping on every single entry
+const finderBatch = 64
+
+// upper bound on how long a throttled batch is allowed to pause for
+const finderBatchDuration = 50 * time.Millisecond
+
+type indexEntry struct {
+	path  string
+	lower string
+}
+
+// finder holds a background-built, in-memory index of paths under the
+// working directory for the `:find`/`:fuzzy` commands, modeled on the
+// producer/consumer walker used by the godoc corpus indexer.
+type finder struct {
+	mu      sync.RWMutex
+	entries []indexEntry
+}
+
+func newFinder() *finder {
+	return &finder{}
+}
+
+// reindex walks root in the background and rebuilds the index. Callers
+// needing the result should use query after reindex returns, or rely on a
+// previously built index while this one is still running.
+func (fd *finder) reindex(root string) {
+	paths := make(chan string, finderBatch)
+	entries := make(chan indexEntry, finderBatch)
+
+	var workers sync.WaitGroup
+	workers.Add(finderIndexers)
+	for i := 0; i < finderIndexers; i++ {
+		go func() {
+			defer workers.Done()
+			for path := range paths {
+				entries <- indexEntry{path: path, lower: strings.ToLower(path)}
+			}
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(entries)
+	}()
+
+	go func() {
+		count := 0
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if path != root && info.IsDir() && !shouldIndexDir(path) {
+				return filepath.SkipDir
+			}
+
+			paths <- path
+			count++
+			if count%finderBatch == 0 {
+				time.Sleep(time.Duration((1 - gOpts.indexthrottle) * float64(finderBatchDuration)))
+			}
+			return nil
+		})
+		close(paths)
+	}()
+
+	indexed := make([]indexEntry, 0, 1024)
+	for e := range entries {
+		indexed = append(indexed, e)
+	}
+
+	sort.Slice(indexed, func(i, j int) bool { return entryLess(indexed[i], indexed[j]) })
+
+	fd.mu.Lock()
+	fd.entries = indexed
+	fd.mu.Unlock()
+}
+
+// shouldIndexDir reports whether dir should be descended into, consulting
+// the indexdir pattern list so things like .git, node_modules, or mount
+// points can be skipped.
+func shouldIndexDir(dir string) bool {
+	base := filepath.Base(dir)
+	for _, pattern := range gOpts.indexdir {
+		if matched, _ := filepath.Match(pattern, base); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// entryLess orders entries case-insensitively by path, breaking ties on the
+// real path so entries whose names only differ by case (e.g. README vs
+// readme) each get their own, distinct slot.
+func entryLess(a, b indexEntry) bool {
+	if a.lower != b.lower {
+		return a.lower < b.lower
+	}
+	return a.path < b.path
+}
+
+// query answers a substring-or-glob search against the current index
+// synchronously, reusing the same ignorecase/smartcase/globsearch semantics
+// as nav's own searchNext/searchPrev.
+func (fd *finder) query(pattern string) ([]string, error) {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+
+	var matches []string
+	for _, e := range fd.entries {
+		matched, err := match(pattern, e.path)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, e.path)
+		}
+	}
+	return matches, nil
+}
+
+// update incrementally adds or removes a single path from the index. It is
+// driven by the fsnotify watcher (see nav.watchLoop) so the index doesn't go
+// stale between full reindex calls. Entries are keyed on the real path, not
+// its lowercased form, so two paths that only differ by case don't collide.
+func (fd *finder) update(path string, exists bool) {
+	e := indexEntry{path: path, lower: strings.ToLower(path)}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	i := sort.Search(len(fd.entries), func(i int) bool { return !entryLess(fd.entries[i], e) })
+
+	if i < len(fd.entries) && fd.entries[i].path == path {
+		if !exists {
+			fd.entries = append(fd.entries[:i], fd.entries[i+1:]...)
+		}
+		return
+	}
+
+	if exists {
+		fd.entries = append(fd.entries, indexEntry{})
+		copy(fd.entries[i+1:], fd.entries[i:])
+		fd.entries[i] = e
+	}
+}
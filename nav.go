@@ -2,19 +2,30 @@ package main
 
 import (
 	"bufio"
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
+// events on a watched directory are coalesced for this long before being
+// turned into a reload, so a burst from e.g. a git checkout causes a single
+// redraw instead of one per touched file
+const watchDebounce = 100 * time.Millisecond
+
 type linkState byte
 
 const (
@@ -28,6 +39,7 @@ type file struct {
 	linkState linkState
 	path      string
 	count     int
+	total     int64
 }
 
 type filesSortable struct {
@@ -212,19 +224,117 @@ func (dir *dir) find(name string, height int) {
 	dir.pos = min(dir.ind, height-edge-1)
 }
 
+// regKey identifies a cached preview by path, modtime, and size so an
+// edited file misses the cache and is re-previewed.
+type regKey struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// regLRU is a fixed-capacity, least-recently-used cache of *reg previews,
+// replacing the previous unbounded map so long sessions don't accumulate an
+// ever-growing set of previews in memory. It is written from both the UI
+// goroutine (loadReg) and the background goroutines spawned per preview, so
+// every access is guarded by mu.
+type regLRU struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List
+	items map[regKey]*list.Element
+}
+
+type regEntry struct {
+	key regKey
+	reg *reg
+}
+
+func newRegLRU(capacity int) *regLRU {
+	return &regLRU{
+		cap:   capacity,
+		ll:    list.New(),
+		items: make(map[regKey]*list.Element),
+	}
+}
+
+func (c *regLRU) get(key regKey) (*reg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*regEntry).reg, true
+}
+
+func (c *regLRU) set(key regKey, r *reg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*regEntry).reg = r
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&regEntry{key: key, reg: r})
+
+	for c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*regEntry).key)
+	}
+}
+
+// dirCount carries a computed recursive count/total for the directory at
+// path back to the owning goroutine, which is the only one allowed to write
+// those fields on the shared *file held in dir.fi/dir.all.
+type dirCount struct {
+	path  string
+	count int
+	total int64
+}
+
 type nav struct {
 	dirs     []*dir
 	dirChan  chan *dir
 	regChan  chan *reg
-	dirCache map[string]*dir
-	regCache map[string]*reg
-	saves    map[string]bool
-	marks    map[string]int
-	markInd  int
-	height   int
-	search   string
+	sizeChan chan dirCount
+	// watchMu guards dirCache and watchFallback, which are now written
+	// both from the goroutine that owns navigation (loadDir, renew,
+	// reload) and from watchLoop, which reacts to fsnotify events
+	// asynchronously.
+	watchMu       sync.Mutex
+	dirCountChan  chan *file
+	dropChan      chan string
+	dirCache      map[string]*dir
+	regCache      *regLRU
+	saves         map[string]bool
+	marks         map[string]int
+	markInd       int
+	height        int
+	search        string
+	finder        *finder
+	watcher       *fsnotify.Watcher
+	watchFallback map[string]bool
+	previewCancel context.CancelFunc
+	previewKey    regKey
 }
 
+// number of goroutines kept around to walk directories for `dircounts`; kept
+// small since the work is disk-bound and not worth oversubscribing
+const dirCountWorkers = 3
+
+// dirCountQueue bounds how many directories can be queued for counting
+// before enqueueCounts starts dropping entries rather than blocking the
+// goroutine loading the directory they belong to
+const dirCountQueue = 64
+
 func newNav(height int) *nav {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -232,21 +342,140 @@ func newNav(height int) *nav {
 	}
 
 	nav := &nav{
-		dirChan:  make(chan *dir),
-		regChan:  make(chan *reg),
-		dirCache: make(map[string]*dir),
-		regCache: make(map[string]*reg),
-		marks:    make(map[string]int),
-		saves:    make(map[string]bool),
-		markInd:  0,
-		height:   height,
+		dirChan:       make(chan *dir),
+		regChan:       make(chan *reg),
+		sizeChan:      make(chan dirCount, dirCountQueue),
+		dirCountChan:  make(chan *file, dirCountQueue),
+		dropChan:      make(chan string),
+		dirCache:      make(map[string]*dir),
+		regCache:      newRegLRU(gOpts.previewcache),
+		marks:         make(map[string]int),
+		saves:         make(map[string]bool),
+		markInd:       0,
+		height:        height,
+		finder:        newFinder(),
+		watchFallback: make(map[string]bool),
+	}
+
+	// always started, even if dircounts starts out disabled, so toggling
+	// the option on at runtime (`:set dircounts`) takes effect immediately
+	// instead of only at startup; enqueueCounts is what actually gates on
+	// gOpts.dircounts, so idle workers just block on an empty channel
+	for i := 0; i < dirCountWorkers; i++ {
+		go nav.dirCountWorker()
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("starting directory watcher: %s", err)
+	} else {
+		nav.watcher = watcher
+		go nav.watchLoop()
 	}
 
 	nav.getDirs(wd)
 
+	go nav.finder.reindex(wd)
+
 	return nav
 }
 
+// query looks up paths in the finder index matching pattern. Unlike
+// searchNext/searchPrev, which only search within the current directory,
+// this searches the whole indexed tree rooted at the working directory.
+func (nav *nav) query(pattern string) ([]string, error) {
+	return nav.finder.query(pattern)
+}
+
+// dirCountWorker pulls directory entries off dirCountChan and computes their
+// recursive count/total, reporting the result on sizeChan as a dirCount
+// rather than writing f.count/f.total directly: f is also held in dir.fi and
+// read from the ui goroutine, so this worker must not mutate it in place. A
+// fresh visited set is used per entry so a single symlink loop or
+// hard-linked tree doesn't get counted more than once within that walk.
+func (nav *nav) dirCountWorker() {
+	for f := range nav.dirCountChan {
+		visited := make(map[fileid]struct{})
+		if lstat, err := os.Lstat(f.path); err == nil {
+			visited[fileId(lstat, f.path)] = struct{}{}
+		}
+
+		count, total := countDir(f.path, visited)
+
+		// non-blocking: if the ui isn't draining sizeChan fast enough,
+		// drop the update rather than stall this worker, which would
+		// otherwise back up into dirCountChan and stall dir loading
+		select {
+		case nav.sizeChan <- dirCount{path: f.path, count: count, total: total}:
+		default:
+		}
+	}
+}
+
+// enqueueCounts schedules background size/count computation for the
+// directory entries of d, if the dircounts option is enabled. Sends are
+// non-blocking so a saturated walker never stalls the caller, which is
+// usually a goroutine that still needs to deliver d itself over dirChan.
+func (nav *nav) enqueueCounts(d *dir) {
+	if !gOpts.dircounts {
+		return
+	}
+
+	for _, f := range d.fi {
+		if !f.IsDir() {
+			continue
+		}
+		select {
+		case nav.dirCountChan <- f:
+		default:
+			// walker is saturated; f keeps its placeholder count
+			// until the next reload/renew/watch-triggered reload
+		}
+	}
+}
+
+// countDir recursively counts the entries and total size of the directory at
+// path, skipping any entry whose (dev, ino) pair is already in visited so
+// symlink cycles and hard-linked duplicates aren't counted more than once.
+func countDir(path string, visited map[fileid]struct{}) (count int, total int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		log.Printf("counting directory: %s", err)
+	}
+
+	for _, name := range names {
+		fpath := filepath.Join(path, name)
+
+		lstat, err := os.Lstat(fpath)
+		if err != nil {
+			continue
+		}
+
+		id := fileId(lstat, fpath)
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+		count++
+
+		if lstat.IsDir() {
+			c, t := countDir(fpath, visited)
+			count += c
+			total += t
+		} else {
+			total += lstat.Size()
+		}
+	}
+
+	return
+}
+
 func (nav *nav) position() {
 	path := nav.currDir().path
 	for i := len(nav.dirs) - 2; i >= 0; i-- {
@@ -271,18 +500,141 @@ func (nav *nav) getDirs(wd string) {
 	nav.dirs = dirs
 }
 
+// watchDirLocked registers path with the directory watcher. If no watcher is
+// running or the path can't be added (e.g. an inotify limit was hit), the
+// directory falls back to the mtime-polling behavior of renew, and the
+// failure is logged once. Callers must hold watchMu.
+func (nav *nav) watchDirLocked(path string) {
+	if nav.watcher == nil {
+		nav.watchFallback[path] = true
+		return
+	}
+	if err := nav.watcher.Add(path); err != nil {
+		log.Printf("watching directory, falling back to polling: %s", err)
+		nav.watchFallback[path] = true
+	}
+}
+
+// unwatchDirLocked undoes watchDirLocked for an entry evicted from dirCache.
+// Callers must hold watchMu.
+func (nav *nav) unwatchDirLocked(path string) {
+	delete(nav.watchFallback, path)
+	if nav.watcher != nil {
+		nav.watcher.Remove(path)
+	}
+}
+
+// resetDirCache replaces dirCache with keep, unwatching any path that was
+// cached before but isn't being kept.
+func (nav *nav) resetDirCache(keep map[string]*dir) {
+	nav.watchMu.Lock()
+	defer nav.watchMu.Unlock()
+
+	for path := range nav.dirCache {
+		if _, ok := keep[path]; !ok {
+			nav.unwatchDirLocked(path)
+		}
+	}
+	nav.dirCache = keep
+}
+
+// watchLoop applies fsnotify events on watched directories, coalescing
+// bursts into a single reload per directory every watchDebounce.
+func (nav *nav) watchLoop() {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(watchDebounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	timerSet := false
+
+	for {
+		select {
+		case ev, ok := <-nav.watcher.Events:
+			if !ok {
+				return
+			}
+
+			// keep the finder index in sync with the same events that
+			// drive directory reloads, instead of waiting on the next
+			// full reindex
+			removed := ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0
+			nav.finder.update(ev.Name, !removed)
+
+			pending[filepath.Dir(ev.Name)] = true
+
+			// a Remove/Rename on ev.Name itself, rather than on an
+			// entry inside it, means the watched directory is gone;
+			// make sure that gets handled as a drop of ev.Name, not
+			// just a reload of its parent
+			nav.watchMu.Lock()
+			_, watchedSelf := nav.dirCache[ev.Name]
+			nav.watchMu.Unlock()
+			if watchedSelf && ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				pending[ev.Name] = true
+			}
+
+			if !timerSet {
+				timer.Reset(watchDebounce)
+				timerSet = true
+			}
+		case err, ok := <-nav.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watching directory: %s", err)
+		case <-timer.C:
+			timerSet = false
+			for path := range pending {
+				delete(pending, path)
+				// handled in its own goroutine so a slow
+				// dirChan/dropChan consumer can't stall the
+				// event loop and delay coalescing further bursts
+				go nav.handleWatchEvent(path)
+			}
+		}
+	}
+}
+
+// handleWatchEvent reloads or drops the watched directory at path in
+// response to a coalesced burst of fsnotify events on it.
+func (nav *nav) handleWatchEvent(path string) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		nav.watchMu.Lock()
+		delete(nav.dirCache, path)
+		nav.unwatchDirLocked(path)
+		nav.watchMu.Unlock()
+
+		nav.dropChan <- path
+		return
+	}
+
+	nd := newDir(path)
+	nd.sort()
+	nav.enqueueCounts(nd)
+	nav.dirChan <- nd
+}
+
 func (nav *nav) renew(height int) {
-	nav.dirCache = make(map[string]*dir)
+	newCache := make(map[string]*dir)
 	for _, d := range nav.dirs {
-		nav.dirCache[d.path] = d
+		newCache[d.path] = d
 	}
+	nav.resetDirCache(newCache)
 
 	nav.height = height
 	for _, d := range nav.dirs {
+		nav.watchMu.Lock()
+		fallback := nav.watchFallback[d.path]
+		nav.watchMu.Unlock()
+		if !fallback {
+			continue
+		}
 		go func(d *dir) {
 			s, err := os.Stat(d.path)
 			if err != nil {
 				log.Printf("getting directory info: %s", err)
+				return
 			}
 			if d.loadTime.After(s.ModTime()) {
 				return
@@ -290,6 +642,7 @@ func (nav *nav) renew(height int) {
 			d.loadTime = time.Now()
 			nd := newDir(d.path)
 			nd.sort()
+			nav.enqueueCounts(nd)
 			nav.dirChan <- nd
 		}(d)
 	}
@@ -305,8 +658,12 @@ func (nav *nav) renew(height int) {
 }
 
 func (nav *nav) reload() {
-	nav.dirCache = make(map[string]*dir)
-	nav.regCache = make(map[string]*reg)
+	nav.resetDirCache(make(map[string]*dir))
+	nav.regCache = newRegLRU(gOpts.previewcache)
+	if nav.previewCancel != nil {
+		nav.previewCancel()
+		nav.previewCancel = nil
+	}
 
 	wd, err := os.Getwd()
 	if err != nil {
@@ -319,34 +676,63 @@ func (nav *nav) reload() {
 		last := nav.dirs[len(nav.dirs)-1]
 		last.fi = append(last.fi, curr)
 	}
+
+	go nav.finder.reindex(wd)
 }
 
 func (nav *nav) loadDir(path string) *dir {
+	nav.watchMu.Lock()
 	d, ok := nav.dirCache[path]
-	if !ok {
-		go func() {
-			d := newDir(path)
-			d.sort()
-			d.ind, d.pos = 0, 0
-			nav.dirChan <- d
-		}()
-		d := &dir{loading: true, path: path}
-		nav.dirCache[path] = d
+	if ok {
+		nav.watchMu.Unlock()
 		return d
 	}
+
+	d = &dir{loading: true, path: path}
+	nav.dirCache[path] = d
+	nav.watchDirLocked(path)
+	nav.watchMu.Unlock()
+
+	go func() {
+		nd := newDir(path)
+		nd.sort()
+		nd.ind, nd.pos = 0, 0
+		nav.enqueueCounts(nd)
+		nav.dirChan <- nd
+	}()
+
 	return d
 }
 
-func (nav *nav) preview() {
-	curr, err := nav.currFile()
-	if err != nil {
-		return
+// previewerFor resolves the previewer command for path, preferring a
+// per-mimetype match in gOpts.previewers (keyed by extension or by mimetype
+// category, e.g. "pdf" or "image") over the catch-all gOpts.previewer.
+func previewerFor(path string) string {
+	if len(gOpts.previewers) != 0 {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+		if previewer, ok := gOpts.previewers[ext]; ok {
+			return previewer
+		}
+
+		if parts := strings.SplitN(mime.TypeByExtension(filepath.Ext(path)), "/", 2); len(parts) == 2 {
+			if previewer, ok := gOpts.previewers[parts[0]]; ok {
+				return previewer
+			}
+		}
 	}
 
+	return gOpts.previewer
+}
+
+// preview runs the previewer for path and sends the result on regChan,
+// caching it under key. ctx is canceled by loadReg as soon as the cursor
+// moves on to another file, so a slow previewer (e.g. a video thumbnailer)
+// is killed instead of piling up as a zombie.
+func (nav *nav) preview(ctx context.Context, path string, key regKey) {
 	var reader io.Reader
 
-	if len(gOpts.previewer) != 0 {
-		cmd := exec.Command(gOpts.previewer, curr.path, strconv.Itoa(nav.height))
+	if previewer := previewerFor(path); len(previewer) != 0 {
+		cmd := exec.CommandContext(ctx, previewer, path, strconv.Itoa(nav.height))
 
 		out, err := cmd.StdoutPipe()
 		if err != nil {
@@ -361,23 +747,31 @@ func (nav *nav) preview() {
 		defer out.Close()
 		reader = out
 	} else {
-		f, err := os.Open(curr.path)
+		f, err := os.Open(path)
 		if err != nil {
 			log.Printf("opening file: %s", err)
+			return
 		}
 
 		defer f.Close()
 		reader = f
 	}
 
-	reg := &reg{path: curr.path}
+	reg := &reg{path: path}
 
 	buf := bufio.NewScanner(reader)
 
 	for i := 0; i < nav.height && buf.Scan(); i++ {
+		if ctx.Err() != nil {
+			return
+		}
 		for _, r := range buf.Text() {
 			if r == 0 {
+				if ctx.Err() != nil {
+					return
+				}
 				reg.lines = []string{"\033[1mbinary\033[0m"}
+				nav.regCache.set(key, reg)
 				nav.regChan <- reg
 				return
 			}
@@ -389,18 +783,56 @@ func (nav *nav) preview() {
 		log.Printf("loading file: %s", buf.Err())
 	}
 
+	if ctx.Err() != nil {
+		return
+	}
+
+	nav.regCache.set(key, reg)
 	nav.regChan <- reg
 }
 
 func (nav *nav) loadReg(ui *ui, path string) *reg {
-	r, ok := nav.regCache[path]
-	if !ok {
-		go nav.preview()
-		r := &reg{path: path, lines: []string{"\033[1mloading...\033[0m"}}
-		nav.regCache[path] = r
+	if gOpts.nopreview {
+		return &reg{path: path}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("previewing file: %s", err)
+		return &reg{path: path}
+	}
+
+	key := regKey{path: path, modTime: info.ModTime(), size: info.Size()}
+
+	// the cursor has moved on to another file: stop the preview of the
+	// previous one even when this one is served from the cache
+	if nav.previewCancel != nil && nav.previewKey != key {
+		nav.previewCancel()
+		nav.previewCancel = nil
+	}
+
+	if r, ok := nav.regCache.get(key); ok {
 		return r
 	}
-	return r
+
+	// a preview already in flight for this exact key: don't cancel and
+	// respawn it, just let the caller keep showing the loading placeholder
+	if nav.previewCancel != nil {
+		return &reg{path: path, lines: []string{"\033[1mloading...\033[0m"}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	nav.previewCancel = cancel
+	nav.previewKey = key
+
+	go nav.preview(ctx, path, key)
+
+	// deliberately not cached: preview() is the only writer of completed
+	// results, so a preview canceled mid-flight (e.g. the cursor moved
+	// away and back before a slow previewer finished) is treated as a
+	// cache miss next time instead of getting stuck behind a stale
+	// "loading..." entry that nothing will ever replace
+	return &reg{path: path, lines: []string{"\033[1mloading...\033[0m"}}
 }
 
 func (nav *nav) sort() {